@@ -0,0 +1,130 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	etcd "github.com/name5566/leaf/etcd"
+	"go.etcd.io/etcd/clientv3"
+)
+
+var errConfigConflict = errors.New("config has been modified by someone else, revision mismatch")
+
+type configEntry struct {
+	data []byte
+	rev  int64
+}
+
+var (
+	configMu      sync.RWMutex
+	configCache   = make(map[string]*configEntry) // name -> 最近一次读到/watch到的内容
+	configWatched = make(map[string]bool)         // name -> 是否已经BindWatcher
+)
+
+// GetConfig 读取name对应的配置并反序列化到out，命中本地缓存时不再访问etcd
+func GetConfig(name string, out interface{}) error {
+	configMu.RLock()
+	entry, cached := configCache[name]
+	configMu.RUnlock()
+
+	if !cached {
+		var err error
+		entry, err = readConfigEntry(name)
+		if err != nil {
+			return err
+		}
+
+		configMu.Lock()
+		configCache[name] = entry
+		configMu.Unlock()
+	}
+
+	return json.Unmarshal(entry.data, out)
+}
+
+// PutConfig 写入name对应的配置。expectRevision非0时，通过etcd事务保证
+// "mod-revision仍等于expectRevision"的判断与写入在同一个Txn里原子完成(CAS)，
+// 中间不会有第三方写入插入进来，从而真正避免更新丢失
+func PutConfig(name string, v interface{}, expectRevision int64) error {
+	path := GetConfigPath(name)
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if expectRevision != 0 {
+		txnResp, err := etcd.Client().Txn(context.Background()).
+			If(clientv3.Compare(clientv3.ModRevision(path), "=", expectRevision)).
+			Then(clientv3.OpPut(path, string(data))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if !txnResp.Succeeded {
+			return errConfigConflict
+		}
+	} else if err := etcd.MarshalKey(path, v); err != nil {
+		return err
+	}
+
+	configMu.Lock()
+	delete(configCache, name) // 让下一次GetConfig重新拉取并缓存最新revision
+	configMu.Unlock()
+
+	return nil
+}
+
+// WatchConfig 监听name对应的配置变化：每次写入都会重新读取、刷新本地缓存并回调onChange(newVal, rev)；
+// 配置被删除时只清掉本地缓存，不回调onChange；重新读取失败时也不回调
+func WatchConfig(name string, onChange func(newVal []byte, rev int64)) error {
+	path := GetConfigPath(name)
+
+	configMu.Lock()
+	if configWatched[path] {
+		configMu.Unlock()
+		return nil
+	}
+	configWatched[path] = true
+	configMu.Unlock()
+
+	return etcd.BindWatcher(path, func(vtype string, key, values []byte, other01 int, other02 string, other03 float64) {
+		if vtype == "DELETE" {
+			configMu.Lock()
+			delete(configCache, name)
+			configMu.Unlock()
+			return
+		}
+
+		entry, err := readConfigEntry(name)
+		if err != nil {
+			return
+		}
+
+		configMu.Lock()
+		configCache[name] = entry
+		configMu.Unlock()
+
+		onChange(entry.data, entry.rev)
+	}, 0, "", 0.0)
+}
+
+// readConfigEntry 精确读取path这一个key，而不是信任ReadAll(prefix)返回的第一条结果——
+// 后者在另一个以path为前缀的key存在时(如"config/db-readonly"之于"config/db")会静默串读
+func readConfigEntry(name string) (*configEntry, error) {
+	path := GetConfigPath(name)
+
+	resp, err := etcd.ReadAll(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range resp.Kvs {
+		if string(resp.Kvs[i].Key) == path {
+			return &configEntry{data: resp.Kvs[i].Value, rev: resp.Kvs[i].ModRevision}, nil
+		}
+	}
+
+	return nil, errors.New("config " + name + " not found")
+}
@@ -1,6 +1,7 @@
 package cluster
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,8 +10,9 @@ import (
 	"github.com/name5566/leaf/log"
 	"go.etcd.io/etcd/clientv3"
 	"gopkg.in/mgo.v2/bson"
-	"math"
 	"strings"
+	"sync"
+	"time"
 )
 
 //服务信息
@@ -24,18 +26,40 @@ type ServerInfo struct {
 	ClientCount    int    `json:"clientCount"`    //客户端数量
 	MaxClientCount int    `json:"maxClientCount"` //最大客户端数量
 	GlobalId       string `json:"globalId"`       //全局唯一id
+
+	Tags map[string]string `json:"tags,omitempty"` //自定义标签，供ServerSelector按条件过滤
+
+	Health          string `json:"health,omitempty"`          //健康状态：healthy/degraded/unhealthy
+	HealthCheckAddr string `json:"healthCheckAddr,omitempty"` //健康检查地址，为空时退化为ListenAddr
 }
 
 var (
 	ttl           int64            = 45
 	LeaseID       clientv3.LeaseID = 0
-	serverMap                      = make(map[string]map[string]*ServerInfo)
-	serverIdMap                    = make(map[string]clientv3.LeaseID)
-	ConfigPath                     = "config"
-	PathSeparator                  = "/"
+	leaseMu       sync.Mutex
+	leaseCancel   context.CancelFunc // 取消当前的superviseLease supervisor goroutine
+	serverMu      sync.RWMutex       // 保护serverMap不被watch/resync/健康检查等goroutine并发读写
+	serverMap     = make(map[string]map[string]*ServerInfo)
+	serverIdMap   = make(map[string]clientv3.LeaseID)
+	ConfigPath    = "config"
+	PathSeparator = "/"
+
+	minReRegisterBackoff = time.Second
+	maxReRegisterBackoff = 30 * time.Second
+
+	watchedPrefixesMu sync.Mutex
+	watchedPrefixes   = make(map[string]bool)
 )
 
 func RegisterServer() {
+	RegisterServerWithContext(context.Background())
+}
+
+// RegisterServerWithContext 与RegisterServer相同，但允许调用方通过ctx
+// 取消续约失败后的自动重新注册supervisor，用于服务优雅退出的场景。
+// cancel也会被RemoveServer自动调用，保证注销时supervisor不会把刚撤销的
+// 注册重新写回etcd
+func RegisterServerWithContext(ctx context.Context) {
 	err := etcd.Dial(conf.Endpoints)
 	if err != nil {
 		log.Fatal(err.Error())
@@ -43,7 +67,30 @@ func RegisterServer() {
 	}
 
 	// 服务注册
-	serverInfo := ServerInfo{
+	serverInfo := newLocalServerInfo()
+
+	id, keepaliveCh, err := registerAndKeeplive(serverInfo)
+	if err != nil {
+		log.Fatal(err.Error())
+		return
+	}
+
+	setLeaseID(id)
+
+	watchServer(serverInfo.Type)
+
+	for _, prefix := range conf.Watcher {
+		watchServer(prefix)
+	}
+
+	superviseCtx, cancel := context.WithCancel(ctx)
+	setLeaseCancel(cancel)
+
+	go superviseLease(superviseCtx, serverInfo, keepaliveCh)
+}
+
+func newLocalServerInfo() *ServerInfo {
+	return &ServerInfo{
 		Name:           conf.ServerName,
 		Type:           conf.ServerType,
 		TCPAddr:        conf.TCPAddr,
@@ -54,32 +101,132 @@ func RegisterServer() {
 		MaxClientCount: 65536,
 		GlobalId:       bson.NewObjectId().Hex(), //生成全局唯一id
 	}
+}
 
-	prefix := serverInfo.Type
+// registerAndKeeplive 向etcd写入serverInfo并开始续约，返回续约channel供supervisor监听
+func registerAndKeeplive(serverInfo *ServerInfo) (clientv3.LeaseID, <-chan *clientv3.LeaseKeepAliveResponse, error) {
 	id, err := etcd.MarshalKeyTTL(
-		GetEtcdClientKey(&serverInfo), serverInfo,
+		GetEtcdClientKey(serverInfo), *serverInfo,
 		ttl)
-
 	if err != nil {
-		log.Fatal(err.Error())
-		return
+		return 0, nil, err
 	}
 
 	// 持续启动续约
-	_, err = etcd.Keeplive(id)
+	ch, err := etcd.Keeplive(id)
 	if err != nil {
-		log.Fatal(err.Error())
+		return 0, nil, err
 	}
 
-	LeaseID = id
+	return id, ch, nil
+}
 
-	watchServer(prefix)
+// superviseLease 监听续约channel，一旦etcd服务器重启/租约失效导致channel关闭，
+// 就重新拨号、重新注册、重新watch，直到ctx被取消
+func superviseLease(ctx context.Context, serverInfo *ServerInfo, keepaliveCh <-chan *clientv3.LeaseKeepAliveResponse) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case resp, ok := <-keepaliveCh:
+			if ok && resp != nil {
+				continue
+			}
 
-	for _, prefix := range conf.Watcher {
-		watchServer(prefix)
+			// channel关闭或收到nil，说明etcd服务器重启了，续约已失效
+			log.Release("续约已失效，开始重新注册服务")
+			keepaliveCh = reRegisterServer(ctx, serverInfo)
+			if keepaliveCh == nil {
+				return // ctx被取消
+			}
+		}
 	}
 }
 
+// reRegisterServer 以指数退避不断重试，直到重新注册成功（保留GlobalId）或ctx被取消
+func reRegisterServer(ctx context.Context, serverInfo *ServerInfo) <-chan *clientv3.LeaseKeepAliveResponse {
+	backoff := minReRegisterBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		if err := etcd.Dial(conf.Endpoints); err != nil {
+			log.Error("重新连接etcd失败: %s", err.Error())
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		id, ch, err := registerAndKeeplive(currentSelfServerInfo(serverInfo))
+		if err != nil {
+			log.Error("重新注册服务失败: %s", err.Error())
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		setLeaseID(id)
+
+		watchServer(serverInfo.Type)
+		for _, prefix := range conf.Watcher {
+			watchServer(prefix)
+		}
+
+		log.Release("服务重新注册成功，lease:%v", id)
+		return ch
+	}
+}
+
+// currentSelfServerInfo 返回serverMap中自身当前条目的一份快照，ClientCount/Health等
+// 字段会被UpdateServerInfo/ReportHealth持续更新到那个条目上；取不到时(比如还没收到过
+// 自己的watch事件)才退化为调用方传入的fallback，以免丢失ClientCount、Health这些活跃状态。
+// 返回的是拷贝而不是live指针，避免调用方在锁外读取时和其它goroutine的原地写入发生数据竞争
+func currentSelfServerInfo(fallback *ServerInfo) *ServerInfo {
+	key := GetEtcdClientKey(fallback)
+
+	serverMu.RLock()
+	defer serverMu.RUnlock()
+
+	if live, ok := serverMap[fallback.Type][key]; ok {
+		snapshot := *live
+		return &snapshot
+	}
+	return fallback
+}
+
+func nextBackoff(cur time.Duration) time.Duration {
+	next := cur * 2
+	if next > maxReRegisterBackoff {
+		return maxReRegisterBackoff
+	}
+	return next
+}
+
+func setLeaseID(id clientv3.LeaseID) {
+	leaseMu.Lock()
+	LeaseID = id
+	leaseMu.Unlock()
+}
+
+func getLeaseID() clientv3.LeaseID {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	return LeaseID
+}
+
+func setLeaseCancel(cancel context.CancelFunc) {
+	leaseMu.Lock()
+	leaseCancel = cancel
+	leaseMu.Unlock()
+}
+
+func getLeaseCancel() context.CancelFunc {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	return leaseCancel
+}
+
 //获得etcd key
 func GetEtcdClientKey(serverInfo *ServerInfo) string {
 	return strings.Join([]string{serverInfo.Type, serverInfo.Name}, PathSeparator)
@@ -107,29 +254,104 @@ func ListConfig() (map[string]string, error) {
 }
 
 func RemoveServer() {
-	etcd.Revoke(LeaseID) // 强制过期
+	if cancel := getLeaseCancel(); cancel != nil {
+		cancel() // 先停掉supervisor，避免它把马上要撤销的租约重新注册回去
+	}
+
+	etcd.Revoke(getLeaseID()) // 强制过期
 	etcd.Close()
 }
 
-// 监控服务器
+// 监控服务器。重连场景下(chunk0-2的reRegisterServer)同一个prefix可能被多次调用，
+// 这里保证BindWatcher/startServerSync只生效一次，避免watch和resync ticker重复累加
 func watchServer(prefix string) {
-	_serverMap, exists := serverMap[prefix]
-	if !exists {
-		_serverMap = make(map[string]*ServerInfo, 0)
+	watchedPrefixesMu.Lock()
+	alreadyWatched := watchedPrefixes[prefix]
+	watchedPrefixes[prefix] = true
+	watchedPrefixesMu.Unlock()
+
+	serverMu.Lock()
+	if _, exists := serverMap[prefix]; !exists {
+		serverMap[prefix] = make(map[string]*ServerInfo)
 	}
-	serverMap[prefix] = _serverMap
+	serverMu.Unlock()
 
 	resp, err := etcd.ReadAll(prefix)
 	if err != nil {
 		log.Fatal(err.Error())
+		return
 	}
 	readServiceList(resp, prefix)
 
+	if alreadyWatched {
+		return
+	}
+
 	err = etcd.BindWatcher(prefix, watchHandler, 0, prefix, 0.0)
 	if err != nil {
 		log.Fatal(err.Error())
 		return
 	}
+
+	startServerSync(prefix)
+}
+
+// 定期重新拉取prefix下的服务器列表并与serverMap对账，
+// 防止etcd重连/压缩导致watch事件丢失后serverMap长期不一致
+func startServerSync(prefix string) {
+	interval := conf.SyncServersInterval
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			syncServerList(prefix)
+		}
+	}()
+}
+
+func syncServerList(prefix string) {
+	resp, err := etcd.ReadAll(prefix)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	latest := make(map[string]string, len(resp.Kvs))
+	for i := range resp.Kvs {
+		if v := resp.Kvs[i].Value; v != nil {
+			key := string(resp.Kvs[i].Key)
+			latest[key] = string(v)
+		}
+	}
+
+	serverMu.RLock()
+	var toAdd []string
+	for key := range latest {
+		if _, exists := serverMap[prefix][key]; !exists {
+			toAdd = append(toAdd, key)
+		}
+	}
+	var toDel []string
+	for key := range serverMap[prefix] {
+		if _, exists := latest[key]; !exists {
+			toDel = append(toDel, key)
+		}
+	}
+	serverMu.RUnlock()
+
+	// 补齐watch遗漏的新增
+	for _, key := range toAdd {
+		addServerList(prefix, key, latest[key])
+	}
+
+	// 清理watch遗漏的删除
+	for _, key := range toDel {
+		delServerList(prefix, key)
+	}
 }
 
 func watchHandler(vtype string, key, values []byte, other01 int, other02 string, other03 float64) {
@@ -160,20 +382,33 @@ func addServerList(prefix string, key, val string) {
 		return
 	}
 
+	serverMu.Lock()
+	old := serverMap[prefix][key]
 	serverMap[prefix][key] = serverInfo
+	serverMu.Unlock()
 
 	addClusterClient(serverInfo)
+	startHealthCheck(prefix, key, serverInfo)
+
+	if old == nil {
+		publish(Event{Type: Added, Prefix: prefix, Key: key, New: serverInfo})
+	} else if !sameServerInfo(old, serverInfo) {
+		publish(Event{Type: Updated, Prefix: prefix, Key: key, Old: old, New: serverInfo})
+	}
 
 	log.Release("set data key:%s val:%v", key, serverInfo)
 }
 
 func delServerList(prefix string, key string) {
+	serverMu.Lock()
 	serverInfo := serverMap[prefix][key]
-
 	delete(serverMap[prefix], key)
+	serverMu.Unlock()
 
 	if serverInfo != nil {
 		removeClusterClient(serverInfo)
+		stopHealthCheck(prefix, key)
+		publish(Event{Type: Removed, Prefix: prefix, Key: key, Old: serverInfo})
 		if strings.Join([]string{conf.ServerType, conf.ServerName}, PathSeparator) == key { //当前服务器
 			//Todo etcd服务器重启了
 			log.Release("etcd服务器重启了")
@@ -183,34 +418,48 @@ func delServerList(prefix string, key string) {
 	log.Release("del data key:%s", key)
 }
 
-func addClusterClient(serverInfo *ServerInfo) {
-	if conf.ServerType == "frontServer" && serverInfo.Type != "frontServer" {
-		if serverInfo.ListenAddr != "" {
-			AddClient(serverInfo.Name, serverInfo.ListenAddr)
-		}
-	} else if conf.ServerType == "chatServer" {
-		if serverInfo.Type == "frontServer" {
-			if serverInfo.ListenAddr != "" {
-				AddClient(serverInfo.Name, serverInfo.ListenAddr)
-			}
+// clusterRoute 描述了"当本机是SourceType时，应该与哪些其它服务器建立rpc连接"
+type clusterRoute struct {
+	SourceType string
+	Filter     ServerFilter
+}
+
+var clusterRoutes = []clusterRoute{
+	{SourceType: "frontServer", Filter: Not(FilterByType("frontServer"))},
+	{SourceType: "chatServer", Filter: FilterByType("frontServer")},
+}
+
+func clusterRouteMatches(serverInfo *ServerInfo) bool {
+	for _, route := range clusterRoutes {
+		if route.SourceType == conf.ServerType && route.Filter(serverInfo) {
+			return true
 		}
 	}
+	return false
+}
+
+func addClusterClient(serverInfo *ServerInfo) {
+	if clusterRouteMatches(serverInfo) && serverInfo.ListenAddr != "" && isHealthy(serverInfo) {
+		AddClient(serverInfo.Name, serverInfo.ListenAddr)
+	}
 }
 
 func removeClusterClient(serverInfo *ServerInfo) {
-	if conf.ServerType == "frontServer" && serverInfo.Type != "frontServer" {
-		if serverInfo.ListenAddr != "" {
-			RemoveClient(serverInfo.Name)
-		}
-	} else if conf.ServerType == "chatServer" {
-		if serverInfo.Type == "frontServer" {
-			RemoveClient(serverInfo.Name)
-		}
+	if clusterRouteMatches(serverInfo) && serverInfo.ListenAddr != "" {
+		RemoveClient(serverInfo.Name)
 	}
 }
 
 func GetServerMap(prefix string) map[string]*ServerInfo {
-	return serverMap[prefix]
+	serverMu.RLock()
+	defer serverMu.RUnlock()
+
+	src := serverMap[prefix]
+	out := make(map[string]*ServerInfo, len(src))
+	for key, serverInfo := range src {
+		out[key] = serverInfo
+	}
+	return out
 }
 
 func GetBestServerInfo(args ...interface{}) ([]interface{}, error) {
@@ -235,10 +484,10 @@ func GetBestServerInfo(args ...interface{}) ([]interface{}, error) {
 				return nil, err
 			}
 
-			if tempServerInfo.GlobalId == serverInfo.GlobalId { //相同表示服务器信息没有改变
+			if tempServerInfo.GlobalId == serverInfo.GlobalId && isHealthy(&tempServerInfo) { //服务器信息没变且仍然健康，才继续复用
 				return []interface{}{serverInfo.Name, serverInfo.WSAddr}, nil
 			}
-			err = etcd.Delete(key, false) //删除进入的服务器信息
+			err = etcd.Delete(key, false) //服务器信息已变化或已不健康，删除进入的服务器信息，走下面重新选择
 			if err != nil {
 				log.Debug(err.Error())
 			}
@@ -247,15 +496,36 @@ func GetBestServerInfo(args ...interface{}) ([]interface{}, error) {
 		}
 	}
 
-	var serverInfo *ServerInfo
+	selectorName := defaultSelectorName
+	if len(args) > 2 && args[2] != nil {
+		if name, ok := args[2].(string); ok {
+			selectorName = name
+		}
+	}
+
+	var filters []ServerFilter
+	if len(args) > 3 && args[3] != nil {
+		if fs, ok := args[3].([]ServerFilter); ok {
+			filters = fs
+		}
+	}
+
+	// 在锁内拷贝出快照再交给selector，selector.Select()之后在锁外读取
+	// ClientCount/Weight/GlobalId这些字段，不能再持有serverMu的live指针，
+	// 否则会和UpdateServerInfo/setPeerHealth/ReportHealth的原地写竞争
+	serverMu.RLock()
+	var candidates []*ServerInfo
 	if _serverMap, ok := serverMap[serverType]; ok {
-		minClientCount := math.MaxInt32
 		for _, _serverInfo := range _serverMap {
-			if _serverInfo.ClientCount < minClientCount && _serverInfo.ClientCount < _serverInfo.MaxClientCount {
-				serverInfo = _serverInfo
+			if isHealthy(_serverInfo) && matchesFilters(_serverInfo, filters) {
+				snapshot := *_serverInfo
+				candidates = append(candidates, &snapshot)
 			}
 		}
 	}
+	serverMu.RUnlock()
+
+	serverInfo := getSelector(selectorName).Select(candidates)
 
 	if serverInfo == nil {
 		return nil, errors.New(fmt.Sprintf("No %s server to alloc", serverType))
@@ -280,10 +550,20 @@ func UpdateServerInfo(args ...interface{}) {
 	serverType := args[0].(string)
 	serverName := args[1].(string)
 	clientCount := args[2].(int)
+
+	serverMu.Lock()
 	serviceInfo, ok := serverMap[serverType][serverName]
+	var snapshot ServerInfo
 	if ok {
 		serviceInfo.ClientCount = clientCount
-		err := etcd.MarshalKeyGrent(GetEtcdClientKey(serviceInfo), serviceInfo, serverIdMap[serverName])
+		snapshot = *serviceInfo
+	}
+	serverMu.Unlock()
+
+	if ok {
+		// 锁外只marshal锁内拷贝出的快照，避免和setPeerHealth/ReportHealth对同一个
+		// *ServerInfo原地写Health产生数据竞争
+		err := etcd.MarshalKeyGrent(GetEtcdClientKey(&snapshot), &snapshot, serverIdMap[serverName])
 		if err != nil {
 			log.Error(err.Error())
 		}
@@ -0,0 +1,90 @@
+package cluster
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// EventType 描述了一次serverMap变化的性质
+type EventType int
+
+const (
+	Added EventType = iota
+	Updated
+	Removed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Added:
+		return "Added"
+	case Updated:
+		return "Updated"
+	case Removed:
+		return "Removed"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event 是Subscribe回调收到的一次服务器成员变化
+type Event struct {
+	Type   EventType
+	Prefix string
+	Key    string
+	Old    *ServerInfo
+	New    *ServerInfo
+}
+
+type subscription struct {
+	prefix  string
+	handler func(evt Event)
+}
+
+var (
+	subMu   sync.Mutex
+	subs    = make(map[uint64]*subscription)
+	nextSub uint64
+)
+
+// Subscribe 订阅指定prefix下的服务器成员变化，prefix为空表示订阅所有prefix。
+// 返回的unsubscribe函数用于取消订阅
+func Subscribe(prefix string, handler func(evt Event)) (unsubscribe func()) {
+	subMu.Lock()
+	nextSub++
+	id := nextSub
+	subs[id] = &subscription{prefix: prefix, handler: handler}
+	subMu.Unlock()
+
+	return func() {
+		subMu.Lock()
+		delete(subs, id)
+		subMu.Unlock()
+	}
+}
+
+func publish(evt Event) {
+	subMu.Lock()
+	handlers := make([]func(Event), 0, len(subs))
+	for _, sub := range subs {
+		if sub.prefix == "" || sub.prefix == evt.Prefix {
+			handlers = append(handlers, sub.handler)
+		}
+	}
+	subMu.Unlock()
+
+	for _, handler := range handlers {
+		handler(evt)
+	}
+}
+
+// sameServerInfo 通过比较JSON序列化结果判断两次ServerInfo是否等价，
+// 用于区分一次PUT到底是新增还是仅仅ClientCount/weight之类字段的更新
+func sameServerInfo(a, b *ServerInfo) bool {
+	aj, errA := json.Marshal(a)
+	bj, errB := json.Marshal(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return string(aj) == string(bj)
+}
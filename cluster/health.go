@@ -0,0 +1,148 @@
+package cluster
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/name5566/leaf/conf"
+	etcd "github.com/name5566/leaf/etcd"
+	"github.com/name5566/leaf/log"
+)
+
+var errNotRegistered = errors.New("local server info not found")
+
+// 健康状态，"lease存活于etcd"不等于"能正常处理连接"，这里单独做一层TCP探测
+const (
+	HealthHealthy   = "healthy"
+	HealthDegraded  = "degraded"
+	HealthUnhealthy = "unhealthy"
+)
+
+var (
+	healthMu     sync.Mutex
+	healthStopCh = make(map[string]chan struct{}) // key: prefix+PathSeparator+key
+)
+
+// isHealthy 没有上报过健康状态的老数据视为healthy，兼容未开启健康检查的服务
+func isHealthy(serverInfo *ServerInfo) bool {
+	return serverInfo.Health == "" || serverInfo.Health == HealthHealthy
+}
+
+// startHealthCheck 为serverMap中新增的一个peer启动健康检查goroutine，自己不检查自己
+func startHealthCheck(prefix, key string, serverInfo *ServerInfo) {
+	if serverInfo.Type == conf.ServerType && serverInfo.Name == conf.ServerName {
+		return
+	}
+
+	addr := serverInfo.HealthCheckAddr
+	if addr == "" {
+		addr = serverInfo.ListenAddr
+	}
+	if addr == "" || conf.HealthCheckInterval <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	mapKey := prefix + PathSeparator + key
+
+	healthMu.Lock()
+	if old, exists := healthStopCh[mapKey]; exists {
+		close(old)
+	}
+	healthStopCh[mapKey] = stop
+	healthMu.Unlock()
+
+	go runHealthCheck(prefix, key, addr, stop)
+}
+
+func stopHealthCheck(prefix, key string) {
+	mapKey := prefix + PathSeparator + key
+
+	healthMu.Lock()
+	stop, exists := healthStopCh[mapKey]
+	if exists {
+		delete(healthStopCh, mapKey)
+	}
+	healthMu.Unlock()
+
+	if exists {
+		close(stop)
+	}
+}
+
+func runHealthCheck(prefix, key, addr string, stop chan struct{}) {
+	ticker := time.NewTicker(conf.HealthCheckInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			conn, err := net.DialTimeout("tcp", addr, conf.HealthCheckTimeout)
+			if err != nil {
+				failures++
+			} else {
+				conn.Close()
+				failures = 0
+			}
+
+			setPeerHealth(prefix, key, healthFromFailures(failures))
+		}
+	}
+}
+
+func healthFromFailures(failures int) string {
+	switch {
+	case failures >= conf.HealthCheckFailureThreshold:
+		return HealthUnhealthy
+	case failures > 0:
+		return HealthDegraded
+	default:
+		return HealthHealthy
+	}
+}
+
+// setPeerHealth 更新本地缓存里一个peer的健康状态。这个状态变化只发生在本机，
+// 不会像ReportHealth那样经过etcd，所以这里顺带publish一次Updated事件，
+// 否则Subscribe的调用方只能看到对端自己上报的健康变化，看不到本地探测到的
+func setPeerHealth(prefix, key, health string) {
+	serverMu.Lock()
+	serverInfo, ok := serverMap[prefix][key]
+	if !ok || serverInfo.Health == health {
+		serverMu.Unlock()
+		return
+	}
+	old := *serverInfo
+	serverInfo.Health = health
+	serverMu.Unlock()
+
+	log.Debug("%s health changed to %s", key, health)
+	publish(Event{Type: Updated, Prefix: prefix, Key: key, Old: &old, New: serverInfo})
+}
+
+// ReportHealth 上报本机的健康状态，通过重新发布ServerInfo让其它节点经由现有的watch链路感知到
+func ReportHealth(health string) error {
+	key := strings.Join([]string{conf.ServerType, conf.ServerName}, PathSeparator)
+
+	serverMu.Lock()
+	serverInfo, ok := serverMap[conf.ServerType][key]
+	var snapshot ServerInfo
+	if ok {
+		serverInfo.Health = health
+		snapshot = *serverInfo
+	}
+	serverMu.Unlock()
+
+	if !ok {
+		return errNotRegistered
+	}
+
+	// 锁外只marshal锁内拷贝出的快照，避免和UpdateServerInfo对同一个*ServerInfo
+	// 原地写ClientCount产生数据竞争
+	return etcd.MarshalKeyGrent(GetEtcdClientKey(&snapshot), &snapshot, getLeaseID())
+}
@@ -0,0 +1,203 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// ServerFilter 用于从候选服务器中筛掉不满足条件的服务器
+type ServerFilter func(serverInfo *ServerInfo) bool
+
+// FilterByType 只保留指定类型的服务器
+func FilterByType(serverType string) ServerFilter {
+	return func(serverInfo *ServerInfo) bool {
+		return serverInfo.Type == serverType
+	}
+}
+
+// FilterByTag 只保留Tags[key]等于value的服务器
+func FilterByTag(key, value string) ServerFilter {
+	return func(serverInfo *ServerInfo) bool {
+		return serverInfo.Tags[key] == value
+	}
+}
+
+// Not 对filter取反
+func Not(filter ServerFilter) ServerFilter {
+	return func(serverInfo *ServerInfo) bool {
+		return !filter(serverInfo)
+	}
+}
+
+func matchesFilters(serverInfo *ServerInfo, filters []ServerFilter) bool {
+	for _, filter := range filters {
+		if !filter(serverInfo) {
+			return false
+		}
+	}
+	return true
+}
+
+// ServerSelector 从候选服务器中选出一个，没有合适的返回nil
+type ServerSelector interface {
+	Select(servers []*ServerInfo) *ServerInfo
+}
+
+// ServerSelectorFunc 让普通函数满足ServerSelector接口
+type ServerSelectorFunc func(servers []*ServerInfo) *ServerInfo
+
+func (f ServerSelectorFunc) Select(servers []*ServerInfo) *ServerInfo {
+	return f(servers)
+}
+
+// withCapacity 过滤掉已经达到MaxClientCount的服务器
+func withCapacity(servers []*ServerInfo) []*ServerInfo {
+	candidates := make([]*ServerInfo, 0, len(servers))
+	for _, serverInfo := range servers {
+		if serverInfo.ClientCount < serverInfo.MaxClientCount {
+			candidates = append(candidates, serverInfo)
+		}
+	}
+	return candidates
+}
+
+// LeastConnections 选择当前客户端数量最少的服务器
+var LeastConnections ServerSelector = ServerSelectorFunc(func(servers []*ServerInfo) *ServerInfo {
+	var best *ServerInfo
+	minClientCount := math.MaxInt32
+	for _, serverInfo := range withCapacity(servers) {
+		if serverInfo.ClientCount < minClientCount {
+			minClientCount = serverInfo.ClientCount
+			best = serverInfo
+		}
+	}
+	return best
+})
+
+// WeightedRandom 按ServerInfo.Weight加权随机选择
+var WeightedRandom ServerSelector = ServerSelectorFunc(func(servers []*ServerInfo) *ServerInfo {
+	candidates := withCapacity(servers)
+
+	totalWeight := 0
+	for _, serverInfo := range candidates {
+		totalWeight += serverInfo.Weight
+	}
+	if totalWeight <= 0 {
+		return Random.Select(candidates)
+	}
+
+	r := rand.Intn(totalWeight)
+	for _, serverInfo := range candidates {
+		r -= serverInfo.Weight
+		if r < 0 {
+			return serverInfo
+		}
+	}
+	return nil
+})
+
+// Random 在候选服务器中随机选择一个
+var Random ServerSelector = ServerSelectorFunc(func(servers []*ServerInfo) *ServerInfo {
+	candidates := withCapacity(servers)
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+})
+
+type roundRobinSelector struct {
+	mu      sync.Mutex
+	counter uint64
+}
+
+func (s *roundRobinSelector) Select(servers []*ServerInfo) *ServerInfo {
+	candidates := withCapacity(servers)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].GlobalId < candidates[j].GlobalId
+	})
+
+	s.mu.Lock()
+	idx := s.counter % uint64(len(candidates))
+	s.counter++
+	s.mu.Unlock()
+
+	return candidates[idx]
+}
+
+// RoundRobin 按GlobalId排序后轮询选择，适合无状态请求的均匀分摊
+var RoundRobin ServerSelector = &roundRobinSelector{}
+
+// ConsistentHash 返回一个按key做一致性哈希的selector，相同key总是落到同一台服务器上，
+// 适合按用户id做粘滞路由
+func ConsistentHash(key string) ServerSelector {
+	return ServerSelectorFunc(func(servers []*ServerInfo) *ServerInfo {
+		candidates := withCapacity(servers)
+		if len(candidates) == 0 {
+			return nil
+		}
+
+		// 每个候选者的哈希值只算一次，排序时复用，而不是让sort.Slice在每次比较时重新哈希
+		type ring struct {
+			hash       uint32
+			serverInfo *ServerInfo
+		}
+		nodes := make([]ring, len(candidates))
+		for i, serverInfo := range candidates {
+			nodes[i] = ring{hash: hashString(serverInfo.GlobalId), serverInfo: serverInfo}
+		}
+
+		sort.Slice(nodes, func(i, j int) bool {
+			return nodes[i].hash < nodes[j].hash
+		})
+
+		hash := hashString(key)
+		for _, node := range nodes {
+			if node.hash >= hash {
+				return node.serverInfo
+			}
+		}
+		return nodes[0].serverInfo // 绕回哈希环起点
+	})
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+var (
+	defaultSelectorName = "least_connections"
+
+	selectorsMu sync.RWMutex
+	selectors   = map[string]ServerSelector{
+		"least_connections": LeastConnections,
+		"weighted_random":   WeightedRandom,
+		"round_robin":       RoundRobin,
+		"random":            Random,
+	}
+)
+
+// RegisterSelector 注册一个自定义的ServerSelector，可以在GetBestServerInfo的
+// args中按name引用
+func RegisterSelector(name string, selector ServerSelector) {
+	selectorsMu.Lock()
+	selectors[name] = selector
+	selectorsMu.Unlock()
+}
+
+func getSelector(name string) ServerSelector {
+	selectorsMu.RLock()
+	defer selectorsMu.RUnlock()
+	if selector, ok := selectors[name]; ok {
+		return selector
+	}
+	return selectors[defaultSelectorName]
+}